@@ -0,0 +1,78 @@
+// Copyright (c) 2021 Wireleap
+
+package ststore
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// atomicSet marshals v to JSON and writes it at the path built from the
+// store's root directory and ps, using a write-to-temp-then-rename so that
+// a crash mid-write can never leave a truncated file behind: New's walk
+// would otherwise fail to parse it and abort loading the whole store. This
+// supplements fsdir.T.Set, which writes in place, for the paths ststore
+// itself produces (live sharetokens and quarantined copies). fsdir.T.Set
+// itself is unchanged and still writes in place: calling it directly
+// instead of going through ststore reopens the same truncated-file crash
+// window this file exists to close.
+func (t *T) atomicSet(v interface{}, ps ...string) error {
+	path := filepath.Join(append([]string{t.m.Path()}, ps...)...)
+	dir := filepath.Dir(path)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+
+	return atomicWriteFile(path, data)
+}
+
+// atomicWriteFile writes data to path via a temp file in the same
+// directory, fsyncing both the temp file and the directory so the rename
+// is durable across a crash.
+func atomicWriteFile(path string, data []byte) (err error) {
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+
+	if err != nil {
+		return
+	}
+
+	_, err = f.Write(data)
+
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return
+	}
+
+	if err = f.Close(); err != nil {
+		return
+	}
+
+	if err = os.Rename(tmp, path); err != nil {
+		return
+	}
+
+	df, err := os.Open(filepath.Dir(path))
+
+	if err != nil {
+		return
+	}
+
+	defer df.Close()
+
+	return df.Sync()
+}
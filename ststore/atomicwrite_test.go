@@ -0,0 +1,71 @@
+// Copyright (c) 2021 Wireleap
+
+package ststore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wireleap/common/api/sharetoken"
+)
+
+// TestNewQuarantinesLeftoverTmpFile simulates a crash mid-write: a
+// ".json.tmp" file sits next to (or in place of) the live ".json" file
+// because the process died between the temp file being written and
+// renamed into place. Reopening the store must not abort, and must
+// quarantine the leftover into malformed/ under a ".json" name so it
+// survives the FilterMalformed index across restarts.
+func TestNewQuarantinesLeftoverTmpFile(t *testing.T) {
+	dir := t.TempDir()
+
+	keyf := func(st *sharetoken.T) (string, string, string) {
+		return "k1", "k2", "k3"
+	}
+
+	store, err := New(dir, keyf)
+
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if err := store.Add(&sharetoken.T{}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	live := filepath.Join(dir, "k1", "k3.json")
+	tmp := live + ".tmp"
+
+	// the rename from k3.json.tmp to k3.json never completed: leave the
+	// live file as-is and drop an extra leftover temp file next to it.
+	if err := os.WriteFile(tmp, []byte(`{`), 0600); err != nil {
+		t.Fatalf("simulate crash leftover: %v", err)
+	}
+
+	reopened, err := New(dir, keyf)
+
+	if err != nil {
+		t.Fatalf("New after crash: %v", err)
+	}
+
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("expected the leftover .tmp file to be moved out of the live tree")
+	}
+
+	got := reopened.FilterMalformed("k1")
+
+	if len(got) != 1 || got[0] != "k1/k3.json" {
+		t.Fatalf("FilterMalformed(\"k1\") = %v, want [k1/k3.json]", got)
+	}
+
+	// the .tmp leftover quarantineMalformed moves during the live walk
+	// must not also be picked up a second time by the post-walk scan of
+	// the malformed/ subtree.
+	if got := reopened.FilterMalformed(""); len(got) != 1 {
+		t.Fatalf("FilterMalformed(\"\") = %v, want a single entry, not a duplicate", got)
+	}
+
+	if n := reopened.Count("k1", "k2"); n != 1 {
+		t.Fatalf("expected the original live sharetoken to survive reload untouched, Count = %d", n)
+	}
+}
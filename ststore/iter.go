@@ -0,0 +1,212 @@
+// Copyright (c) 2021 Wireleap
+
+package ststore
+
+import (
+	"sort"
+
+	"github.com/wireleap/common/api/sharetoken"
+)
+
+// Iterator yields the sharetokens matching a Iter call one at a time,
+// without ever materializing the full result set in memory. A read lock is
+// held only for the duration of copying a single k2 bucket's sharetokens,
+// and is released again between buckets, so a long-lived Iterator does not
+// starve writers.
+type Iterator struct {
+	t   *T
+	k2  string
+	k1s []string
+	k1i int
+
+	curK1 string
+	k2s   []string
+	k2i   int
+
+	buf  []*sharetoken.T
+	bufi int
+}
+
+// Iter returns an Iterator over the sharetokens matching k1 and k2, with the
+// same "empty string means all values of this key" semantics as Filter.
+func (t *T) Iter(k1, k2 string) *Iterator {
+	it := &Iterator{t: t, k2: k2}
+
+	if k1 != "" {
+		it.k1s = []string{k1}
+	} else {
+		it.k1s = t.stsKeys()
+	}
+
+	return it
+}
+
+// Next returns the next sharetoken, or ok == false once the iterator is
+// exhausted.
+func (it *Iterator) Next() (st *sharetoken.T, ok bool) {
+	for {
+		if it.bufi < len(it.buf) {
+			st = it.buf[it.bufi]
+			it.bufi++
+			return st, true
+		}
+
+		if it.k2i >= len(it.k2s) {
+			if !it.advanceK1() {
+				return nil, false
+			}
+
+			continue
+		}
+
+		k2 := it.k2s[it.k2i]
+		it.k2i++
+		it.buf = it.t.snapshotBucket(it.curK1, k2)
+		it.bufi = 0
+	}
+}
+
+// advanceK1 moves to the next k1 partition and snapshots its k2 keys.
+func (it *Iterator) advanceK1() bool {
+	if it.k1i >= len(it.k1s) {
+		return false
+	}
+
+	k1 := it.k1s[it.k1i]
+	it.k1i++
+	it.curK1 = k1
+
+	if it.k2 != "" {
+		it.k2s = []string{it.k2}
+		it.k2i = 0
+		return true
+	}
+
+	unlock := it.t.RLockKey(k1)
+	m2 := it.t.getPartition(k1)
+	it.k2s = make([]string, 0, len(m2))
+
+	for k2 := range m2 {
+		it.k2s = append(it.k2s, k2)
+	}
+
+	unlock()
+	it.k2i = 0
+
+	return true
+}
+
+// snapshotBucket copies the sharetokens filed under k1/k2 while holding k1's
+// read lock, then releases it before the caller ranges over the copy.
+func (t *T) snapshotBucket(k1, k2 string) []*sharetoken.T {
+	unlock := t.RLockKey(k1)
+	defer unlock()
+
+	m1 := t.getPartition(k1)[k2]
+	r := make([]*sharetoken.T, 0, len(m1))
+
+	for _, st := range m1 {
+		r = append(r, st)
+	}
+
+	return r
+}
+
+// Page returns up to limit sharetokens matching k1 and k2, ordered by their
+// k3 (signature), starting at cursor. An empty string for either of the
+// keys means "for all values of this key", the same semantics as Filter,
+// Iter and Count: Page("", "", cursor, limit) pages over the entire store.
+// The returned nextCursor is empty once the last page has been reached,
+// otherwise it is the cursor to pass for the following call.
+//
+// Page drives the same bucket-by-bucket Iter traversal used by Iter,
+// keeping only the smallest limit+1 entries seen so far (by k3) instead of
+// collecting and sorting every matching sharetoken, so a page fetch stays
+// bounded by limit rather than by the size of the store.
+//
+// k3 is assumed to be unique across the whole store (it is the
+// sharetoken's signature), so merging buckets under a wildcard k1 or k2
+// still produces a single, gap-free ordering to paginate over.
+func (t *T) Page(k1, k2, cursor string, limit int) (r []*sharetoken.T, nextCursor string) {
+	window := limit
+
+	if window < 0 {
+		window = 0
+	}
+
+	type entry struct {
+		k3 string
+		st *sharetoken.T
+	}
+
+	// top holds, in ascending k3 order, the smallest window+1 entries with
+	// k3 >= cursor seen so far. The (window+1)th entry, once one exists,
+	// becomes nextCursor without ever sorting the full k3 set.
+	top := make([]entry, 0, window+1)
+
+	it := t.Iter(k1, k2)
+
+	for {
+		st, ok := it.Next()
+
+		if !ok {
+			break
+		}
+
+		_, _, k3 := t.keyf(st)
+
+		if cursor != "" && k3 < cursor {
+			continue
+		}
+
+		i := sort.Search(len(top), func(i int) bool { return top[i].k3 >= k3 })
+		top = append(top, entry{})
+		copy(top[i+1:], top[i:])
+		top[i] = entry{k3, st}
+
+		if len(top) > window+1 {
+			top = top[:window+1]
+		}
+	}
+
+	for i := 0; i < len(top) && i < window; i++ {
+		r = append(r, top[i].st)
+	}
+
+	if len(top) > window {
+		nextCursor = top[window].k3
+	}
+
+	return
+}
+
+// Count returns the number of sharetokens matching k1 and k2, with the same
+// "empty string means all values of this key" semantics as Filter. It never
+// materializes the matching sharetokens, only their bucket sizes, so it
+// stays cheap even for stores holding millions of entries.
+func (t *T) Count(k1, k2 string) (n int) {
+	var k1s []string
+
+	if k1 != "" {
+		k1s = []string{k1}
+	} else {
+		k1s = t.stsKeys()
+	}
+
+	for _, k1 := range k1s {
+		unlock := t.RLockKey(k1)
+		m2 := t.getPartition(k1)
+
+		if k2 != "" {
+			n += len(m2[k2])
+		} else {
+			for _, m1 := range m2 {
+				n += len(m1)
+			}
+		}
+
+		unlock()
+	}
+
+	return
+}
@@ -0,0 +1,313 @@
+// Copyright (c) 2021 Wireleap
+
+package ststore
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/wireleap/common/api/sharetoken"
+)
+
+// TestIterEmptyStore checks that an Iterator over an empty store is
+// immediately exhausted rather than panicking or blocking.
+func TestIterEmptyStore(t *testing.T) {
+	dir := t.TempDir()
+
+	keyf := func(st *sharetoken.T) (string, string, string) {
+		return "k1", "k2", "k3"
+	}
+
+	store, err := New(dir, keyf)
+
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if _, ok := store.Iter("", "").Next(); ok {
+		t.Fatalf("Next() on an empty store returned ok = true")
+	}
+}
+
+// TestIterYieldsEachEntryOnce adds sharetokens spread across multiple k1
+// partitions and k2 buckets and checks that Iter("", "") yields every one
+// of them exactly once.
+func TestIterYieldsEachEntryOnce(t *testing.T) {
+	dir := t.TempDir()
+
+	type key struct{ k1, k2, k3 string }
+
+	assigned := map[*sharetoken.T]key{}
+	n := 0
+
+	keyf := func(st *sharetoken.T) (string, string, string) {
+		k, ok := assigned[st]
+
+		if !ok {
+			n++
+			k1, k2 := "relayA", "peerA"
+
+			if n%3 == 0 {
+				k1 = "relayB"
+			}
+
+			if n%2 == 0 {
+				k2 = "peerB"
+			}
+
+			k = key{k1, k2, fmt.Sprintf("sig-%03d", n)}
+			assigned[st] = k
+		}
+
+		return k.k1, k.k2, k.k3
+	}
+
+	store, err := New(dir, keyf)
+
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	const total = 7
+	want := map[string]bool{}
+
+	for i := 0; i < total; i++ {
+		st := &sharetoken.T{}
+
+		if err := store.Add(st); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+
+		want[assigned[st].k3] = true
+	}
+
+	got := map[string]bool{}
+	n2 := 0
+	it := store.Iter("", "")
+
+	for {
+		st, ok := it.Next()
+
+		if !ok {
+			break
+		}
+
+		n2++
+		k3 := assigned[st].k3
+
+		if got[k3] {
+			t.Fatalf("Iter yielded %s more than once", k3)
+		}
+
+		got[k3] = true
+	}
+
+	if n2 != total {
+		t.Fatalf("Iter yielded %d entries, want %d", n2, total)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Iter yielded %v, want %v", got, want)
+	}
+}
+
+// TestIterReleasesLockBetweenBuckets checks that an in-progress Iterator
+// doesn't hold a k1's lock for the duration of the whole traversal: once
+// Next has returned an entry copied out of one k2 bucket, a concurrent Add
+// under the same k1 must proceed without waiting for the iterator to
+// finish the remaining buckets.
+func TestIterReleasesLockBetweenBuckets(t *testing.T) {
+	dir := t.TempDir()
+
+	n := 0
+
+	keyf := func(st *sharetoken.T) (string, string, string) {
+		n++
+		k2 := "peerA"
+
+		if n%2 == 0 {
+			k2 = "peerB"
+		}
+
+		return "k1", k2, fmt.Sprintf("sig-%03d", n)
+	}
+
+	store, err := New(dir, keyf)
+
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := store.Add(&sharetoken.T{}); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	it := store.Iter("k1", "")
+
+	if _, ok := it.Next(); !ok {
+		t.Fatalf("expected at least one entry from the first bucket")
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- store.Add(&sharetoken.T{})
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Add under k1 blocked while an Iterator for k1 was between buckets")
+	}
+}
+
+// TestCount checks that Count's "all values of this key" wildcard
+// semantics agree with Filter's, across both a fully-wildcarded and a
+// single-k1 call.
+func TestCount(t *testing.T) {
+	dir := t.TempDir()
+
+	type key struct{ k1, k2 string }
+
+	assigned := map[*sharetoken.T]key{}
+	n := 0
+
+	keyf := func(st *sharetoken.T) (string, string, string) {
+		k, ok := assigned[st]
+
+		if !ok {
+			n++
+			k1, k2 := "relayA", "peerA"
+
+			if n%3 == 0 {
+				k1 = "relayB"
+			}
+
+			if n%2 == 0 {
+				k2 = "peerB"
+			}
+
+			k = key{k1, k2}
+			assigned[st] = k
+		}
+
+		return k.k1, k.k2, fmt.Sprintf("sig-%03d", n)
+	}
+
+	store, err := New(dir, keyf)
+
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	const total = 7
+
+	for i := 0; i < total; i++ {
+		if err := store.Add(&sharetoken.T{}); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	if got := store.Count("", ""); got != total {
+		t.Fatalf("Count(\"\", \"\") = %d, want %d", got, total)
+	}
+
+	if got, want := store.Count("", ""), len(store.Filter("", "")); got != want {
+		t.Fatalf("Count(\"\", \"\") = %d, want len(Filter(\"\", \"\")) = %d", got, want)
+	}
+
+	if got, want := store.Count("relayA", ""), len(store.Filter("relayA", "")); got != want {
+		t.Fatalf("Count(\"relayA\", \"\") = %d, want len(Filter(\"relayA\", \"\")) = %d", got, want)
+	}
+}
+
+// TestPageMergesWildcardsAcrossCursor pages through a store spanning
+// multiple k1 partitions and k2 buckets using Page("", "", ...) and checks
+// that every sharetoken is returned exactly once, in k3 order, across
+// however many calls it takes to exhaust the cursor. A prior version of
+// Page treated an empty k1 or k2 as a literal (nonexistent) map key instead
+// of "all values", silently returning nothing for exactly this call.
+func TestPageMergesWildcardsAcrossCursor(t *testing.T) {
+	dir := t.TempDir()
+
+	type key struct{ k1, k2, k3 string }
+
+	assigned := map[*sharetoken.T]key{}
+	n := 0
+
+	keyf := func(st *sharetoken.T) (string, string, string) {
+		k, ok := assigned[st]
+
+		if !ok {
+			n++
+			k1, k2 := "relayA", "peerA"
+
+			if n%3 == 0 {
+				k1 = "relayB"
+			}
+
+			if n%2 == 0 {
+				k2 = "peerB"
+			}
+
+			k = key{k1, k2, fmt.Sprintf("sig-%03d", n)}
+			assigned[st] = k
+		}
+
+		return k.k1, k.k2, k.k3
+	}
+
+	store, err := New(dir, keyf)
+
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	const total = 9
+	want := make([]string, 0, total)
+
+	for i := 0; i < total; i++ {
+		st := &sharetoken.T{}
+
+		if err := store.Add(st); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+
+		want = append(want, assigned[st].k3)
+	}
+
+	sort.Strings(want)
+
+	var got []string
+	cursor := ""
+
+	for {
+		page, next := store.Page("", "", cursor, 4)
+
+		if len(page) == 0 {
+			break
+		}
+
+		for _, st := range page {
+			got = append(got, assigned[st].k3)
+		}
+
+		if next == "" {
+			break
+		}
+
+		cursor = next
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Page(\"\", \"\", ...) across all pages = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Wireleap
+
+package ststore
+
+import "sync"
+
+// keyLock is a reference-counted RWMutex handed out for a single k1
+// partition. Entries are removed from the owning keyLocks once their
+// refcount drops to zero, so long-running stores don't accumulate one
+// lock per k1 ever seen.
+type keyLock struct {
+	mu  sync.RWMutex
+	ref int
+}
+
+// keyLocks hands out per-k1 locks so that operations on disjoint
+// partitions never block each other. The mu field only ever guards the
+// lock table itself, never any sharetoken data, so contention on it is
+// limited to the brief refcount bookkeeping done on every acquire and
+// release, never for as long as a partition's lock is held.
+type keyLocks struct {
+	mu sync.Mutex
+	m  map[string]*keyLock
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{m: map[string]*keyLock{}}
+}
+
+func (kl *keyLocks) acquire(k1 string) *keyLock {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+
+	e := kl.m[k1]
+
+	if e == nil {
+		e = &keyLock{}
+		kl.m[k1] = e
+	}
+
+	e.ref++
+
+	return e
+}
+
+func (kl *keyLocks) release(k1 string, e *keyLock) {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+
+	e.ref--
+
+	if e.ref == 0 {
+		delete(kl.m, k1)
+	}
+}
+
+// LockKey acquires the write lock for the partition identified by k1 and
+// returns a function which releases it. Calls for distinct k1 values never
+// block each other.
+func (kl *keyLocks) LockKey(k1 string) func() {
+	e := kl.acquire(k1)
+	e.mu.Lock()
+
+	return func() {
+		e.mu.Unlock()
+		kl.release(k1, e)
+	}
+}
+
+// RLockKey is the read-lock equivalent of LockKey.
+func (kl *keyLocks) RLockKey(k1 string) func() {
+	e := kl.acquire(k1)
+	e.mu.RLock()
+
+	return func() {
+		e.mu.RUnlock()
+		kl.release(k1, e)
+	}
+}
+
+// LockKey acquires the write lock for the k1 partition of the store and
+// returns a function which releases it.
+func (t *T) LockKey(k1 string) func() {
+	return t.locks.LockKey(k1)
+}
+
+// RLockKey acquires the read lock for the k1 partition of the store and
+// returns a function which releases it.
+func (t *T) RLockKey(k1 string) func() {
+	return t.locks.RLockKey(k1)
+}
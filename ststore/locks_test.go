@@ -0,0 +1,88 @@
+// Copyright (c) 2021 Wireleap
+
+package ststore
+
+import (
+	"testing"
+	"time"
+)
+
+// TestKeyLocksDisjointKeysDontBlock checks the whole point of striping:
+// holding the write lock for one k1 must never block another goroutine
+// from acquiring the lock for a different k1.
+func TestKeyLocksDisjointKeysDontBlock(t *testing.T) {
+	kl := newKeyLocks()
+
+	unlockA := kl.LockKey("a")
+	defer unlockA()
+
+	done := make(chan struct{})
+
+	go func() {
+		unlockB := kl.LockKey("b")
+		unlockB()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("LockKey(\"b\") blocked while only \"a\" was locked")
+	}
+}
+
+// TestKeyLocksSameKeyBlocks is the flip side: two writers for the same k1
+// must still serialize.
+func TestKeyLocksSameKeyBlocks(t *testing.T) {
+	kl := newKeyLocks()
+
+	unlockA := kl.LockKey("a")
+
+	acquired := make(chan struct{})
+
+	go func() {
+		unlockA2 := kl.LockKey("a")
+		close(acquired)
+		unlockA2()
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("LockKey(\"a\") succeeded while another holder still held it")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlockA()
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("LockKey(\"a\") never acquired after the first holder released it")
+	}
+}
+
+// TestKeyLocksRefcountGC checks that a key's lock entry is removed once
+// nothing references it any more, so a long-running store doesn't
+// accumulate one lock per k1 ever seen, and survives while still in use.
+func TestKeyLocksRefcountGC(t *testing.T) {
+	kl := newKeyLocks()
+
+	unlock1 := kl.RLockKey("a")
+	unlock2 := kl.RLockKey("a")
+
+	if n := len(kl.m); n != 1 {
+		t.Fatalf("expected 1 tracked key while in use, got %d", n)
+	}
+
+	unlock1()
+
+	if n := len(kl.m); n != 1 {
+		t.Fatalf("expected the entry to survive while still referenced, got %d entries", n)
+	}
+
+	unlock2()
+
+	if n := len(kl.m); n != 0 {
+		t.Fatalf("expected the entry to be garbage collected after the last release, got %d entries", n)
+	}
+}
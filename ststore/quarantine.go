@@ -0,0 +1,303 @@
+// Copyright (c) 2021 Wireleap
+
+package ststore
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/wireleap/common/api/sharetoken"
+)
+
+// Quarantine subtree names, rooted directly under the store directory.
+const (
+	expiredSubdir   = "expired"
+	malformedSubdir = "malformed"
+)
+
+// ExpiredPath returns the path segments under which a quarantined-for-
+// expiry sharetoken is stored on disk, mirroring the k1/k3 layout of the
+// live tree under an "expired" subtree.
+func (t *T) ExpiredPath(ps ...string) []string {
+	return append([]string{expiredSubdir}, ps...)
+}
+
+// MalformedPath is the malformed-tree equivalent of ExpiredPath.
+func (t *T) MalformedPath(ps ...string) []string {
+	return append([]string{malformedSubdir}, ps...)
+}
+
+// MoveExpired atomically relocates st from the live tree into the expired
+// quarantine and removes it from the in-memory sts map. It is a no-op if st
+// is not currently present in the store.
+func (t *T) MoveExpired(st *sharetoken.T) (err error) {
+	k1, k2, k3 := t.keyf(st)
+
+	unlock := t.LockKey(k1)
+	defer unlock()
+
+	m2 := t.getPartition(k1)
+
+	switch {
+	case m2 == nil, m2[k2] == nil, m2[k2][k3] == nil:
+		return
+	}
+
+	err = t.atomicSet(st, t.ExpiredPath(k1, k3+".json")...)
+
+	if err != nil {
+		return
+	}
+
+	err = t.m.Del(k1, k3+".json")
+
+	if err != nil {
+		return
+	}
+
+	if t.unsetLocked(k1, k2, k3) {
+		err = t.m.Del(k1)
+
+		if err != nil {
+			return
+		}
+	}
+
+	t.qmu.Lock()
+
+	if t.expired[k1] == nil {
+		t.expired[k1] = st1map{}
+	}
+
+	t.expired[k1][k3] = st
+
+	t.qmu.Unlock()
+
+	return
+}
+
+// MoveMalformed atomically relocates st from the live tree into the
+// malformed quarantine and removes it from the in-memory sts map, for
+// sharetokens that parse correctly but are rejected by settlement as
+// invalid. It is a no-op if st is not currently present in the store.
+//
+// Unlike FilterExpired, FilterMalformed only tracks the relative path of
+// quarantined entries: sharetokens that fail to even unmarshal during New
+// can never produce a *sharetoken.T, so both quarantine origins are kept
+// on the same, path-only footing.
+func (t *T) MoveMalformed(st *sharetoken.T) (err error) {
+	k1, k2, k3 := t.keyf(st)
+
+	unlock := t.LockKey(k1)
+	defer unlock()
+
+	m2 := t.getPartition(k1)
+
+	switch {
+	case m2 == nil, m2[k2] == nil, m2[k2][k3] == nil:
+		return
+	}
+
+	err = t.atomicSet(st, t.MalformedPath(k1, k3+".json")...)
+
+	if err != nil {
+		return
+	}
+
+	err = t.m.Del(k1, k3+".json")
+
+	if err != nil {
+		return
+	}
+
+	if t.unsetLocked(k1, k2, k3) {
+		err = t.m.Del(k1)
+
+		if err != nil {
+			return
+		}
+	}
+
+	t.qmu.Lock()
+	t.malformed = append(t.malformed, k1+"/"+k3+".json")
+	t.qmu.Unlock()
+
+	return
+}
+
+// unsetLocked removes the sharetoken filed under k1/k2/k3 from sts,
+// reporting whether k1's partition is now empty and was dropped. Callers
+// must hold k1's write lock.
+func (t *T) unsetLocked(k1, k2, k3 string) (emptied bool) {
+	m2 := t.getPartition(k1)
+
+	delete(m2[k2], k3)
+
+	if len(m2[k2]) == 0 {
+		delete(m2, k2)
+	}
+
+	if len(m2) == 0 {
+		t.deleteSts(k1)
+		emptied = true
+	}
+
+	return
+}
+
+// FilterExpired returns the sharetokens quarantined as expired, optionally
+// restricted to those originally filed under k1. An empty k1 means "for all
+// values of this key".
+func (t *T) FilterExpired(k1 string) (r []*sharetoken.T) {
+	t.qmu.RLock()
+	defer t.qmu.RUnlock()
+
+	if k1 == "" {
+		for _, m := range t.expired {
+			for _, st := range m {
+				r = append(r, st)
+			}
+		}
+
+		return
+	}
+
+	for _, st := range t.expired[k1] {
+		r = append(r, st)
+	}
+
+	return
+}
+
+// FilterMalformed returns the relative on-disk paths of sharetokens
+// quarantined as malformed, optionally restricted to those originally filed
+// under k1. An empty k1 means "for all values of this key".
+func (t *T) FilterMalformed(k1 string) (r []string) {
+	t.qmu.RLock()
+	defer t.qmu.RUnlock()
+
+	for _, p := range t.malformed {
+		if k1 == "" || strings.HasPrefix(p, k1+"/") {
+			r = append(r, p)
+		}
+	}
+
+	return
+}
+
+// quarantineMalformed moves the live file at k1/filename into the malformed
+// quarantine without going through the m.Set/Get path, since a file that
+// failed to unmarshal cannot be round-tripped through a *sharetoken.T. A
+// ".tmp" suffix (a write left over from a crash mid-rename) is stripped from
+// the destination name, so every entry under malformed/ ends in ".json" and
+// loadQuarantine's reload walk, which only matches that suffix, never loses
+// track of it across a restart.
+func (t *T) quarantineMalformed(k1, filename string) error {
+	root := t.m.Path()
+	dstDir := filepath.Join(root, malformedSubdir, k1)
+
+	if err := os.MkdirAll(dstDir, 0700); err != nil {
+		return err
+	}
+
+	dstName := strings.TrimSuffix(filename, ".tmp")
+
+	src := filepath.Join(root, k1, filename)
+	dst := filepath.Join(dstDir, dstName)
+
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+
+	t.qmu.Lock()
+	t.malformed = append(t.malformed, k1+"/"+dstName)
+	t.qmu.Unlock()
+
+	return nil
+}
+
+// loadQuarantine populates t.expired and t.malformed from whatever is
+// already present in the quarantine subtrees on disk, e.g. left over from a
+// previous run.
+func (t *T) loadQuarantine() error {
+	root := t.m.Path()
+
+	err := filepath.Walk(filepath.Join(root, expiredSubdir), func(path string, info os.FileInfo, err error) error {
+		switch {
+		case os.IsNotExist(err):
+			return nil
+		case err != nil:
+			return err
+		case info.IsDir():
+			return nil
+		case strings.HasSuffix(info.Name(), ".tmp"):
+			// the live copy this write would have replaced was only ever
+			// deleted after the quarantine write succeeded, so a leftover
+			// temp file here belongs to nothing and can be dropped.
+			os.Remove(path)
+			return nil
+		case !strings.HasSuffix(info.Name(), ".json"):
+			return nil
+		}
+
+		st := &sharetoken.T{}
+		ps := strings.Split(path, "/")
+		n := len(ps)
+
+		if err := t.m.Get(st, ps[n-3:n]...); err != nil {
+			// leave entries we still can't parse where they are
+			return nil
+		}
+
+		k1 := ps[n-2]
+
+		if t.expired[k1] == nil {
+			t.expired[k1] = st1map{}
+		}
+
+		t.expired[k1][strings.TrimSuffix(ps[n-1], ".json")] = st
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(filepath.Join(root, malformedSubdir), func(path string, info os.FileInfo, err error) error {
+		switch {
+		case os.IsNotExist(err):
+			return nil
+		case err != nil:
+			return err
+		case info.IsDir():
+			return nil
+		case strings.HasSuffix(info.Name(), ".tmp"):
+			// same reasoning as the expired-tree walk above: nothing else
+			// ever pointed at this file, so it's safe to drop.
+			os.Remove(path)
+			return nil
+		case !strings.HasSuffix(info.Name(), ".json"):
+			return nil
+		}
+
+		ps := strings.Split(path, "/")
+		n := len(ps)
+		rel := strings.Join(ps[n-2:n], "/")
+
+		// quarantineMalformed already recorded this path when New's live
+		// walk moved it here earlier this run (both the leftover-.tmp sweep
+		// and the unparseable-file path go through it); only entries left
+		// over from a previous run are new here.
+		for _, p := range t.malformed {
+			if p == rel {
+				return nil
+			}
+		}
+
+		t.malformed = append(t.malformed, rel)
+
+		return nil
+	})
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2021 Wireleap
+
+package ststore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wireleap/common/api/sharetoken"
+)
+
+// TestNewQuarantinesUnparseableLiveFile checks the backlog's headline
+// scenario: a ".json" file that is present (not a crash-leftover ".tmp")
+// but fails to unmarshal must be quarantined into malformed/ during New's
+// walk instead of aborting the whole store from loading.
+func TestNewQuarantinesUnparseableLiveFile(t *testing.T) {
+	dir := t.TempDir()
+
+	keyf := func(st *sharetoken.T) (string, string, string) {
+		return "k1", "k2", "k3"
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "k1"), 0700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+
+	bad := filepath.Join(dir, "k1", "k3.json")
+
+	if err := os.WriteFile(bad, []byte("not json"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	store, err := New(dir, keyf)
+
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if _, err := os.Stat(bad); !os.IsNotExist(err) {
+		t.Fatalf("expected the unparseable file to be moved out of the live tree")
+	}
+
+	got := store.FilterMalformed("k1")
+
+	if len(got) != 1 || got[0] != "k1/k3.json" {
+		t.Fatalf("FilterMalformed(\"k1\") = %v, want [k1/k3.json]", got)
+	}
+
+	if n := store.Count("k1", "k2"); n != 0 {
+		t.Fatalf("expected the unparseable file to be absent from the live store, Count = %d", n)
+	}
+}
+
+// TestMoveExpired checks that MoveExpired relocates a live sharetoken's
+// on-disk file under ExpiredPath, drops it from the live store, and makes
+// it reachable via FilterExpired.
+func TestMoveExpired(t *testing.T) {
+	dir := t.TempDir()
+
+	keyf := func(st *sharetoken.T) (string, string, string) {
+		return "k1", "k2", "k3"
+	}
+
+	store, err := New(dir, keyf)
+
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	st := &sharetoken.T{}
+
+	if err := store.Add(st); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	if err := store.MoveExpired(st); err != nil {
+		t.Fatalf("MoveExpired: %v", err)
+	}
+
+	if n := store.Count("k1", "k2"); n != 0 {
+		t.Fatalf("expected the live store to be empty after MoveExpired, Count = %d", n)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "k1", "k3.json")); !os.IsNotExist(err) {
+		t.Fatalf("expected the live file to be gone after MoveExpired")
+	}
+
+	dst := append([]string{dir}, store.ExpiredPath("k1", "k3.json")...)
+
+	if _, err := os.Stat(filepath.Join(dst...)); err != nil {
+		t.Fatalf("expected the sharetoken at ExpiredPath, stat: %v", err)
+	}
+
+	got := store.FilterExpired("k1")
+
+	if len(got) != 1 || got[0] != st {
+		t.Fatalf("FilterExpired(\"k1\") = %v, want [%v]", got, st)
+	}
+
+	// a second call is a no-op since st is no longer live.
+	if err := store.MoveExpired(st); err != nil {
+		t.Fatalf("MoveExpired (repeat): %v", err)
+	}
+
+	if got := store.FilterExpired("k1"); len(got) != 1 {
+		t.Fatalf("FilterExpired(\"k1\") after repeat MoveExpired = %v, want unchanged", got)
+	}
+}
+
+// TestMoveMalformed checks that MoveMalformed relocates a live sharetoken's
+// on-disk file under MalformedPath, drops it from the live store, and
+// records its path via FilterMalformed.
+func TestMoveMalformed(t *testing.T) {
+	dir := t.TempDir()
+
+	keyf := func(st *sharetoken.T) (string, string, string) {
+		return "k1", "k2", "k3"
+	}
+
+	store, err := New(dir, keyf)
+
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	st := &sharetoken.T{}
+
+	if err := store.Add(st); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	if err := store.MoveMalformed(st); err != nil {
+		t.Fatalf("MoveMalformed: %v", err)
+	}
+
+	if n := store.Count("k1", "k2"); n != 0 {
+		t.Fatalf("expected the live store to be empty after MoveMalformed, Count = %d", n)
+	}
+
+	dst := append([]string{dir}, store.MalformedPath("k1", "k3.json")...)
+
+	if _, err := os.Stat(filepath.Join(dst...)); err != nil {
+		t.Fatalf("expected the sharetoken at MalformedPath, stat: %v", err)
+	}
+
+	got := store.FilterMalformed("k1")
+
+	if len(got) != 1 || got[0] != "k1/k3.json" {
+		t.Fatalf("FilterMalformed(\"k1\") = %v, want [k1/k3.json]", got)
+	}
+}
+
+// TestQuarantinePathsMirrorLiveLayout checks that ExpiredPath and
+// MalformedPath prefix whatever path segments they're given with their own
+// subtree name, leaving the rest of the k1/k3 layout untouched.
+func TestQuarantinePathsMirrorLiveLayout(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := New(dir, func(st *sharetoken.T) (string, string, string) {
+		return "k1", "k2", "k3"
+	})
+
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if got, want := store.ExpiredPath("k1", "k3.json"), []string{"expired", "k1", "k3.json"}; !equalPaths(got, want) {
+		t.Fatalf("ExpiredPath(\"k1\", \"k3.json\") = %v, want %v", got, want)
+	}
+
+	if got, want := store.MalformedPath("k1", "k3.json"), []string{"malformed", "k1", "k3.json"}; !equalPaths(got, want) {
+		t.Fatalf("MalformedPath(\"k1\", \"k3.json\") = %v, want %v", got, want)
+	}
+}
+
+func equalPaths(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -27,42 +27,94 @@ var DuplicateSTError = errors.New("duplicate sharetoken")
 
 // T is the type of a sharetoken store.
 type T struct {
-	m    fsdir.T
-	mu   sync.RWMutex
-	sts  st3map
-	keyf KeyFunc
+	m     fsdir.T
+	sts   st3map
+	keyf  KeyFunc
+	locks *keyLocks
+	mapMu sync.Mutex
+
+	qmu       sync.RWMutex
+	expired   st2map
+	malformed []string
+
+	changed   chan struct{}
+	ready     chan struct{}
+	readyOnce sync.Once
 }
 
 // New initializes a sharetoken store in the directory under the path given by
 // the dir argument.
 func New(dir string, keyf KeyFunc) (t *T, err error) {
-	t = &T{keyf: keyf, sts: st3map{}}
+	t = &T{
+		keyf:    keyf,
+		sts:     st3map{},
+		expired: st2map{},
+		locks:   newKeyLocks(),
+		changed: make(chan struct{}, 1),
+		ready:   make(chan struct{}),
+	}
 	t.m, err = fsdir.New(dir)
 
 	if err != nil {
 		return
 	}
 
-	err = filepath.Walk(t.m.Path(), func(path string, info os.FileInfo, err error) error {
+	root := t.m.Path()
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		switch {
 		case err != nil:
 			return err
-		case !strings.HasSuffix(info.Name(), ".json"):
+		case path == root:
 			return nil
+		case info.IsDir() && filepath.Dir(path) == root && (info.Name() == expiredSubdir || info.Name() == malformedSubdir):
+			// quarantine trees are loaded separately below; skip them here
+			// so their contents never re-enter the live sts map.
+			return filepath.SkipDir
 		}
 
-		st := &sharetoken.T{}
 		ps := strings.Split(path, "/")
 		n := len(ps)
+
+		if strings.HasSuffix(info.Name(), ".tmp") {
+			// leftover from a write that crashed between the temp file
+			// being written and renamed into place. quarantineMalformed
+			// records this path in t.malformed itself; loadQuarantine's
+			// post-walk scan below is what keeps that from being counted
+			// twice once it re-finds the same file already sitting in
+			// malformed/.
+			return t.quarantineMalformed(ps[n-2], ps[n-1])
+		}
+
+		if !strings.HasSuffix(info.Name(), ".json") {
+			return nil
+		}
+
+		st := &sharetoken.T{}
 		err = t.m.Get(st, ps[n-2:n]...)
 
 		if err != nil {
-			return err
+			// rather than aborting the walk, quarantine the file we could
+			// not parse so operators get a durable audit trail of it.
+			return t.quarantineMalformed(ps[n-2], ps[n-1])
 		}
 
-		return t.Add(st)
+		// addLocal, not Add: the file already holds st's on-disk
+		// representation, so routing through Add here would make atomicSet
+		// write-then-rename a fresh <k3>.json.tmp for every live file the
+		// walk visits, destroying any crash-leftover .tmp of the same name
+		// before the walker reaches it.
+		t.addLocal(st)
+
+		return nil
 	})
 
+	if err != nil {
+		return
+	}
+
+	err = t.loadQuarantine()
+
 	return
 }
 
@@ -70,26 +122,24 @@ func New(dir string, keyf KeyFunc) (t *T, err error) {
 // keys generated by t.keyf. It returns DuplicateSTError if this sharetoken
 // was already seen.
 func (t *T) Add(st *sharetoken.T) (err error) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-
 	k1, k2, k3 := t.keyf(st)
 
-	if t.sts[k1] == nil {
-		t.sts[k1] = st2map{}
-	}
+	unlock := t.LockKey(k1)
+	defer unlock()
 
-	if t.sts[k1][k2] == nil {
-		t.sts[k1][k2] = st1map{}
+	m2 := t.getOrCreatePartition(k1)
+
+	if m2[k2] == nil {
+		m2[k2] = st1map{}
 	}
 
-	if t.sts[k1][k2][k3] == nil {
-		t.sts[k1][k2][k3] = st
+	if m2[k2][k3] == nil {
+		m2[k2][k3] = st
 	} else {
 		return DuplicateSTError
 	}
 
-	err = t.m.Set(st, k1, k3+".json")
+	err = t.atomicSet(st, k1, k3+".json")
 
 	if err != nil {
 		return
@@ -102,71 +152,129 @@ func (t *T) Add(st *sharetoken.T) (err error) {
 // under the keys generated by t.keyf. It can return errors from attempting to
 // delete the file associated with the sharetoken on disk.
 func (t *T) Del(st *sharetoken.T) (err error) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-
 	k1, k2, k3 := t.keyf(st)
 
+	unlock := t.LockKey(k1)
+	defer unlock()
+
+	m2 := t.getPartition(k1)
+
 	switch {
-	case t.sts[k1] == nil, t.sts[k1][k2] == nil, t.sts[k1][k2][k3] == nil:
+	case m2 == nil, m2[k2] == nil, m2[k2][k3] == nil:
 		return
 	}
 
-	delete(t.sts[k1][k2], k3)
+	delete(m2[k2], k3)
 	err = t.m.Del(k1, k3+".json")
 
 	if err != nil {
 		return
 	}
 
-	if len(t.sts[k1][k2]) == 0 {
-		delete(t.sts[k1], k2)
+	if len(m2[k2]) == 0 {
+		delete(m2, k2)
 	}
 
-	if len(t.sts[k1]) == 0 {
-		delete(t.sts, k1)
+	if len(m2) == 0 {
+		t.deleteSts(k1)
 		err = t.m.Del(k1)
 	}
 
 	return
 }
 
+// getPartition returns the k1 partition of the store, or nil if nothing has
+// ever been filed under k1. The outer t.sts map is only ever read or
+// written under mapMu: a per-k1 lock guards the contents of a partition
+// once obtained, but never the existence of that partition's key in the
+// outer map, so every access to t.sts itself must go through this helper
+// (or getOrCreatePartition/deleteSts/stsKeys) rather than indexing t.sts
+// directly.
+func (t *T) getPartition(k1 string) st2map {
+	t.mapMu.Lock()
+	defer t.mapMu.Unlock()
+
+	return t.sts[k1]
+}
+
+// getOrCreatePartition is like getPartition but creates an empty partition
+// for k1 if one doesn't exist yet.
+func (t *T) getOrCreatePartition(k1 string) st2map {
+	t.mapMu.Lock()
+	defer t.mapMu.Unlock()
+
+	m2 := t.sts[k1]
+
+	if m2 == nil {
+		m2 = st2map{}
+		t.sts[k1] = m2
+	}
+
+	return m2
+}
+
+// deleteSts removes the now-empty top-level partition for k1. Callers must
+// hold k1's write lock and have already emptied the partition.
+func (t *T) deleteSts(k1 string) {
+	t.mapMu.Lock()
+	defer t.mapMu.Unlock()
+
+	delete(t.sts, k1)
+}
+
+// stsKeys returns a snapshot of the top-level k1 keys currently present in
+// the store.
+func (t *T) stsKeys() []string {
+	t.mapMu.Lock()
+	defer t.mapMu.Unlock()
+
+	ks := make([]string, 0, len(t.sts))
+
+	for k1 := range t.sts {
+		ks = append(ks, k1)
+	}
+
+	return ks
+}
+
 // Filter returns a list of sharetokens matching the given keys k1 and k2. An
 // empty string for either of the keys is assumed to mean "for all values of
-// this key".
+// this key". Each k1 partition is read under its own lock, so a Filter call
+// spanning all of k1 never blocks writers landing sharetokens under a
+// different k1.
 func (t *T) Filter(k1, k2 string) (r []*sharetoken.T) {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
+	if k1 != "" {
+		unlock := t.RLockKey(k1)
+		defer unlock()
 
-	switch {
-	case k1 == "" && k2 == "":
-		// for all k1, k2
-		for _, m1 := range t.sts {
-			for _, m2 := range m1 {
-				for _, st := range m2 {
-					r = append(r, st)
-				}
-			}
-		}
-	case k1 == "":
-		// for all k1, some k2
-		for _, m1 := range t.sts {
-			for _, st := range m1[k2] {
-				r = append(r, st)
-			}
-		}
-	case k2 == "":
-		// for some k1, all k2
-		for _, m2 := range t.sts[k1] {
-			for _, st := range m2 {
+		return filterPartition(t.getPartition(k1), k2)
+	}
+
+	for _, k1 := range t.stsKeys() {
+		unlock := t.RLockKey(k1)
+		r = append(r, filterPartition(t.getPartition(k1), k2)...)
+		unlock()
+	}
+
+	return
+}
+
+// filterPartition collects the sharetokens in a single k1 partition (m2)
+// matching k2, or all of them if k2 is empty. Callers must hold at least a
+// read lock on the corresponding k1.
+func filterPartition(m2 st2map, k2 string) (r []*sharetoken.T) {
+	if k2 == "" {
+		for _, m1 := range m2 {
+			for _, st := range m1 {
 				r = append(r, st)
 			}
 		}
-	default:
-		// for some k1, some k2
-		for _, st := range t.sts[k1][k2] {
-			r = append(r, st)
-		}
+
+		return
+	}
+
+	for _, st := range m2[k2] {
+		r = append(r, st)
 	}
 
 	return
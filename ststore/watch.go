@@ -0,0 +1,258 @@
+// Copyright (c) 2021 Wireleap
+
+package ststore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/wireleap/common/api/sharetoken"
+)
+
+// watchDebounce is how long Watch coalesces a burst of filesystem events
+// (e.g. a batch of sharetokens landing at once) before reconciling them into
+// the in-memory store.
+const watchDebounce = 250 * time.Millisecond
+
+// Watch observes the store's backing directory and reconciles external
+// changes into the in-memory sts map: new sharetoken files are added to it
+// (without rewriting them on disk, see addLocal), removed files trigger an
+// in-memory Del, and modified files replace the
+// existing entry. It blocks until ctx is done or the underlying watcher
+// fails, and is meant to be run in its own goroutine; callers can react to
+// reconciled changes via Changed.
+//
+// Watch only ever reconciles the live tree; changes under the expired and
+// malformed quarantine subtrees are ignored.
+//
+// Registering the filesystem watches happens before Watch does anything
+// else, but that still races a caller that starts Watch with `go
+// t.Watch(ctx)` and immediately mutates the directory itself: the
+// goroutine may not have reached addWatches yet. Callers in that position
+// should wait on Ready before touching the directory.
+func (t *T) Watch(ctx context.Context) error {
+	// closing ready is only done early, right after addWatches succeeds,
+	// below; this defer only covers the error paths before that point, so
+	// a caller waiting on Ready never blocks forever just because Watch
+	// failed to start.
+	defer t.readyOnce.Do(func() { close(t.ready) })
+
+	w, err := fsnotify.NewWatcher()
+
+	if err != nil {
+		return err
+	}
+
+	defer w.Close()
+
+	root := t.m.Path()
+
+	if err := addWatches(w, root); err != nil {
+		return err
+	}
+
+	t.readyOnce.Do(func() { close(t.ready) })
+
+	pending := map[string]struct{}{}
+	timer := time.NewTimer(watchDebounce)
+
+	if !timer.Stop() {
+		<-timer.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+
+			return err
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+
+			if isQuarantinePath(root, ev.Name) {
+				continue
+			}
+
+			if ev.Op&fsnotify.Create != 0 {
+				if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+					w.Add(ev.Name)
+
+					// files written into the new directory before the watch
+					// above was registered produced no events of their own.
+					if des, err := os.ReadDir(ev.Name); err == nil {
+						for _, de := range des {
+							if strings.HasSuffix(de.Name(), ".json") {
+								pending[filepath.Join(ev.Name, de.Name())] = struct{}{}
+								timer.Reset(watchDebounce)
+							}
+						}
+					}
+
+					continue
+				}
+			}
+
+			if !strings.HasSuffix(ev.Name, ".json") {
+				continue
+			}
+
+			pending[ev.Name] = struct{}{}
+			timer.Reset(watchDebounce)
+		case <-timer.C:
+			for path := range pending {
+				t.reconcile(path)
+			}
+
+			pending = map[string]struct{}{}
+			t.notifyChanged()
+		}
+	}
+}
+
+// Changed returns a channel which receives a notification every time Watch
+// reconciles one or more external changes into the store. Sends are
+// non-blocking, so a slow or absent reader only coalesces into the next
+// notification instead of blocking Watch.
+func (t *T) Changed() <-chan struct{} {
+	return t.changed
+}
+
+// Ready returns a channel which is closed once Watch has finished
+// registering its filesystem watches and is safe to race external
+// directory changes against, or once Watch has given up trying (e.g.
+// fsnotify.NewWatcher or addWatches failing) so a caller waiting on it
+// never blocks forever. A caller that starts Watch with `go t.Watch(ctx)`
+// and then immediately mutates the store's directory itself (as opposed
+// to through Add/Del) should wait on Ready first, or risk the mutation
+// landing before the watch is registered and never being reconciled.
+func (t *T) Ready() <-chan struct{} {
+	return t.ready
+}
+
+func (t *T) notifyChanged() {
+	select {
+	case t.changed <- struct{}{}:
+	default:
+	}
+}
+
+// reconcile re-reads path from disk and applies it to the in-memory store,
+// removing the entry if the file is now gone.
+func (t *T) reconcile(path string) {
+	ps := strings.Split(path, "/")
+	n := len(ps)
+
+	if n < 2 {
+		return
+	}
+
+	k1, filename := ps[n-2], ps[n-1]
+
+	if _, err := os.Stat(path); err != nil {
+		t.delByPath(k1, filename)
+		return
+	}
+
+	st := &sharetoken.T{}
+
+	if err := t.m.Get(st, k1, filename); err != nil {
+		t.delByPath(k1, filename)
+		t.quarantineMalformed(k1, filename)
+		return
+	}
+
+	t.delByPath(k1, filename)
+	t.addLocal(st)
+}
+
+// addLocal inserts st into the in-memory sts map under the keys generated
+// by t.keyf, without writing anything to disk. reconcile uses this instead
+// of Add because the file at path already reflects st's content on disk;
+// routing through Add would rewrite it via atomicSet's temp-file+rename,
+// which Watch would then observe as a fresh event on the very same path and
+// reconcile all over again, forever.
+func (t *T) addLocal(st *sharetoken.T) {
+	k1, k2, k3 := t.keyf(st)
+
+	unlock := t.LockKey(k1)
+	defer unlock()
+
+	m2 := t.getOrCreatePartition(k1)
+
+	if m2[k2] == nil {
+		m2[k2] = st1map{}
+	}
+
+	m2[k2][k3] = st
+}
+
+// delByPath removes whatever sharetoken is currently filed under k1 with a
+// k3 matching filename, regardless of its k2. Unlike Del it never touches
+// the file on disk: the caller is reconciling a change that already
+// happened on disk.
+func (t *T) delByPath(k1, filename string) {
+	unlock := t.LockKey(k1)
+	defer unlock()
+
+	m2 := t.getPartition(k1)
+
+	if m2 == nil {
+		return
+	}
+
+	k3 := strings.TrimSuffix(filename, ".json")
+
+	for k2, m1 := range m2 {
+		if _, ok := m1[k3]; !ok {
+			continue
+		}
+
+		delete(m1, k3)
+
+		if len(m1) == 0 {
+			delete(m2, k2)
+		}
+	}
+
+	if len(m2) == 0 {
+		t.deleteSts(k1)
+	}
+}
+
+func isQuarantinePath(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+
+	if err != nil {
+		return false
+	}
+
+	ps := strings.Split(rel, string(filepath.Separator))
+
+	return len(ps) > 0 && (ps[0] == expiredSubdir || ps[0] == malformedSubdir)
+}
+
+func addWatches(w *fsnotify.Watcher, root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case !info.IsDir():
+			return nil
+		case filepath.Dir(path) == root && (info.Name() == expiredSubdir || info.Name() == malformedSubdir):
+			return filepath.SkipDir
+		}
+
+		return w.Add(path)
+	})
+}
@@ -0,0 +1,221 @@
+// Copyright (c) 2021 Wireleap
+
+package ststore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wireleap/common/api/sharetoken"
+)
+
+// startWatch runs Watch in its own goroutine, waits for it to finish
+// registering its filesystem watches, and returns a func that stops it and
+// waits for it to return, mirroring how a caller would manage Watch's
+// lifetime.
+func startWatch(t *testing.T, store *T) (stop func()) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		store.Watch(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-store.Ready():
+	case <-time.After(time.Second):
+		t.Fatalf("Watch did not become ready")
+	}
+
+	return func() {
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("Watch did not return after ctx was cancelled")
+		}
+	}
+}
+
+// waitForChanged blocks until store's Changed channel fires or d elapses,
+// reporting whether it fired in time.
+func waitForChanged(t *testing.T, store *T, d time.Duration) bool {
+	t.Helper()
+
+	select {
+	case <-store.Changed():
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// TestWatchReconcilesExternalAdd checks that a .json file dropped into the
+// store directory out-of-band is picked up into the in-memory store, and
+// that Changed fires once Watch has reconciled it.
+func TestWatchReconcilesExternalAdd(t *testing.T) {
+	dir := t.TempDir()
+
+	keyf := func(st *sharetoken.T) (string, string, string) {
+		return "k1", "k2", "k3"
+	}
+
+	store, err := New(dir, keyf)
+
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	stop := startWatch(t, store)
+	defer stop()
+
+	if err := os.MkdirAll(filepath.Join(dir, "k1"), 0700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "k1", "k3.json"), []byte("{}"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if !waitForChanged(t, store, 2*time.Second) {
+		t.Fatalf("Changed did not fire after an external file was added")
+	}
+
+	if n := store.Count("k1", "k2"); n != 1 {
+		t.Fatalf("Count(\"k1\", \"k2\") = %d after external add, want 1", n)
+	}
+}
+
+// TestWatchReconcilesExternalDel checks that removing a tracked
+// sharetoken's file out-of-band removes it from the in-memory store.
+func TestWatchReconcilesExternalDel(t *testing.T) {
+	dir := t.TempDir()
+
+	keyf := func(st *sharetoken.T) (string, string, string) {
+		return "k1", "k2", "k3"
+	}
+
+	store, err := New(dir, keyf)
+
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if err := store.Add(&sharetoken.T{}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	stop := startWatch(t, store)
+	defer stop()
+
+	if err := os.Remove(filepath.Join(dir, "k1", "k3.json")); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	if !waitForChanged(t, store, 2*time.Second) {
+		t.Fatalf("Changed did not fire after an external file was removed")
+	}
+
+	if n := store.Count("k1", "k2"); n != 0 {
+		t.Fatalf("Count(\"k1\", \"k2\") = %d after external remove, want 0", n)
+	}
+}
+
+// TestWatchReconcilesExternalModify checks that rewriting a tracked
+// sharetoken's file out-of-band replaces its in-memory entry rather than
+// duplicating or dropping it.
+func TestWatchReconcilesExternalModify(t *testing.T) {
+	dir := t.TempDir()
+
+	keyf := func(st *sharetoken.T) (string, string, string) {
+		return "k1", "k2", "k3"
+	}
+
+	store, err := New(dir, keyf)
+
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if err := store.Add(&sharetoken.T{}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	before := store.Filter("k1", "k2")
+
+	if len(before) != 1 {
+		t.Fatalf("expected exactly one entry before the external rewrite, got %d", len(before))
+	}
+
+	stop := startWatch(t, store)
+	defer stop()
+
+	if err := os.WriteFile(filepath.Join(dir, "k1", "k3.json"), []byte("{}"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if !waitForChanged(t, store, 2*time.Second) {
+		t.Fatalf("Changed did not fire after an external rewrite")
+	}
+
+	after := store.Filter("k1", "k2")
+
+	if len(after) != 1 {
+		t.Fatalf("expected exactly one entry after the external rewrite, got %d", len(after))
+	}
+
+	if after[0] == before[0] {
+		t.Fatalf("expected the rewrite to replace the in-memory entry with a new value, not reuse the old one")
+	}
+}
+
+// TestWatchDebounceCoalescesBurst checks that several rapid writes inside
+// the debounce window coalesce into a single Changed notification instead
+// of firing once per event.
+func TestWatchDebounceCoalescesBurst(t *testing.T) {
+	dir := t.TempDir()
+
+	keyf := func(st *sharetoken.T) (string, string, string) {
+		return "k1", "k2", "k3"
+	}
+
+	store, err := New(dir, keyf)
+
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	stop := startWatch(t, store)
+	defer stop()
+
+	if err := os.MkdirAll(filepath.Join(dir, "k1"), 0700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+
+	path := filepath.Join(dir, "k1", "k3.json")
+
+	for i := 0; i < 5; i++ {
+		if err := os.WriteFile(path, []byte("{}"), 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+
+		time.Sleep(watchDebounce / 10)
+	}
+
+	if !waitForChanged(t, store, 2*time.Second) {
+		t.Fatalf("Changed did not fire after a coalesced burst of writes")
+	}
+
+	select {
+	case <-store.Changed():
+		t.Fatalf("Changed fired a second time for a single coalesced burst")
+	case <-time.After(watchDebounce * 2):
+	}
+}